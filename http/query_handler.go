@@ -0,0 +1,892 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/influxdata/flux"
+	"github.com/influxdata/flux/csv"
+	"github.com/influxdata/platform/query"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Compression selects how a FluxService or FluxQueryService negotiates
+// response compression with the server.
+type Compression int
+
+const (
+	// CompressionAuto sends Accept-Encoding: gzip and transparently decodes
+	// whatever supported Content-Encoding the server responds with. It is
+	// the zero value, so it applies unless a request explicitly opts out.
+	CompressionAuto Compression = iota
+	// CompressionNone disables compression negotiation by sending
+	// Accept-Encoding: identity, so the server can't respond compressed and
+	// http.Transport has nothing to decode transparently behind our back.
+	CompressionNone
+	// CompressionGzip behaves like CompressionAuto today. It is kept
+	// distinct so a future encoder can be added as the "auto" default
+	// without silently changing what CompressionGzip callers get.
+	CompressionGzip
+)
+
+// contentDecoder constructs a decoding io.ReadCloser for an HTTP response
+// body compressed with a particular Content-Encoding.
+type contentDecoder func(io.Reader) (io.ReadCloser, error)
+
+// contentDecoders maps Content-Encoding values to their decoder. Additional
+// encodings can be made available to FluxService and FluxQueryService with
+// RegisterContentDecoding.
+var contentDecoders = map[string]contentDecoder{
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+}
+
+// RegisterContentDecoding registers decode as the decoder used whenever a
+// FluxService or FluxQueryService response carries a Content-Encoding
+// header equal to encoding.
+func RegisterContentDecoding(encoding string, decode func(io.Reader) (io.ReadCloser, error)) {
+	contentDecoders[encoding] = decode
+}
+
+// setAcceptEncoding sets the Accept-Encoding header on req according to c.
+func setAcceptEncoding(req *http.Request, c Compression) {
+	if c == CompressionNone {
+		// http.Transport negotiates gzip itself (and transparently
+		// decompresses the response) whenever Accept-Encoding is unset, so
+		// disabling negotiation means sending an explicit header rather
+		// than omitting one.
+		req.Header.Set("Accept-Encoding", "identity")
+		return
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+}
+
+// decodeBody wraps resp.Body in the decoder registered for its
+// Content-Encoding, if any. A body with no Content-Encoding, or with one
+// that has no registered decoder, is returned as is.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	enc := resp.Header.Get("Content-Encoding")
+	decode, ok := contentDecoders[enc]
+	if enc == "" || !ok {
+		return resp.Body, nil
+	}
+
+	r, err := decode(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &decodedBody{r: r, body: resp.Body}, nil
+}
+
+// decodedBody couples a decoding reader to the underlying response body so
+// closing it releases both.
+type decodedBody struct {
+	r    io.ReadCloser
+	body io.ReadCloser
+}
+
+func (d *decodedBody) Read(p []byte) (int, error) { return d.r.Read(p) }
+
+func (d *decodedBody) Close() error {
+	err := d.r.Close()
+	if bodyErr := d.body.Close(); err == nil {
+		err = bodyErr
+	}
+	return err
+}
+
+// ErrDeadlineExceeded is returned by reads and writes bound by a
+// deadlineTimer once their deadline has passed.
+var ErrDeadlineExceeded = errors.New("http: deadline exceeded")
+
+// DefaultRetryPolicy is the RetryPolicy used by FluxService and
+// FluxQueryService when none is configured.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialInterval:     500 * time.Millisecond,
+	MaxInterval:         30 * time.Second,
+	Multiplier:          2,
+	RandomizationFactor: 0.5,
+	MaxElapsedTime:      2 * time.Minute,
+	MaxRetries:          5,
+	RetryableStatuses: []int{
+		http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	},
+}
+
+// Clock abstracts time so tests can drive backoff deterministically.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// RetryPolicy controls how FluxService and FluxQueryService retry requests
+// that fail with a connection error or one of RetryableStatuses. Intervals
+// grow from InitialInterval by Multiplier on every attempt, capped at
+// MaxInterval and jittered by RandomizationFactor, until either MaxRetries
+// attempts have been made or MaxElapsedTime has passed since the first
+// attempt, whichever comes first.
+type RetryPolicy struct {
+	InitialInterval     time.Duration
+	MaxInterval         time.Duration
+	Multiplier          float64
+	RandomizationFactor float64
+	MaxElapsedTime      time.Duration
+	MaxRetries          int
+	RetryableStatuses   []int
+
+	// Clock is used to control time in tests. Defaults to the real clock.
+	Clock Clock
+}
+
+func (p *RetryPolicy) clock() Clock {
+	if p.Clock != nil {
+		return p.Clock
+	}
+	return realClock{}
+}
+
+// isZero reports whether every field of p other than Clock is at its zero
+// value, in which case retryDo substitutes DefaultRetryPolicy, keeping p's
+// Clock. A partially
+// customized policy is left as-is here; retryDo still defaults its
+// MaxRetries and MaxElapsedTime independently, since those two are the
+// bounds that stop a persistent connection error from being retried
+// forever and must never be silently disabled by customizing some other
+// field.
+func (p *RetryPolicy) isZero() bool {
+	return p.InitialInterval == 0 && p.MaxInterval == 0 && p.Multiplier == 0 &&
+		p.RandomizationFactor == 0 && p.MaxElapsedTime == 0 && p.MaxRetries == 0 &&
+		p.RetryableStatuses == nil
+}
+
+func (p *RetryPolicy) isRetryableStatus(code int) bool {
+	for _, s := range p.RetryableStatuses {
+		if s == code {
+			return true
+		}
+	}
+	return false
+}
+
+// nextInterval returns the next backoff interval given the current one,
+// following next = min(MaxInterval, current*Multiplier) * (1 ± rand*RandomizationFactor).
+func (p *RetryPolicy) nextInterval(current time.Duration) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = DefaultRetryPolicy.Multiplier
+	}
+
+	next := time.Duration(float64(current) * multiplier)
+	if p.MaxInterval > 0 && next > p.MaxInterval {
+		next = p.MaxInterval
+	}
+
+	if p.RandomizationFactor > 0 {
+		delta := p.RandomizationFactor * float64(next)
+		next = time.Duration(float64(next) - delta + rand.Float64()*2*delta)
+	}
+
+	return next
+}
+
+// deadlineTimer is a resettable pair of read/write deadlines, modeled after
+// netstack's deadlineTimer: each SetXDeadline call stops the previous timer
+// and arms a new one to close the relevant cancellation channel when the
+// deadline fires (a channel an earlier deadline already closed is replaced),
+// so blocked readers/writers can select on the channel instead of polling a
+// mutex-guarded expiry time. The zero value has no deadlines set.
+type deadlineTimer struct {
+	mu sync.Mutex
+
+	readTimer  *time.Timer
+	readCancel chan struct{}
+
+	writeTimer  *time.Timer
+	writeCancel chan struct{}
+}
+
+// SetReadDeadline arranges for in-flight and future reads to fail with
+// ErrDeadlineExceeded once t is reached. A zero Time disables the deadline.
+func (dt *deadlineTimer) SetReadDeadline(t time.Time) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	// The current channel is kept, so reads already blocked on it are bound
+	// by t, unless an earlier deadline has closed it (or is about to).
+	if dt.readTimer != nil && !dt.readTimer.Stop() {
+		dt.readCancel = nil
+	}
+	dt.readTimer = nil
+	select {
+	case <-dt.readCancel:
+		dt.readCancel = nil
+	default:
+	}
+	if dt.readCancel == nil {
+		dt.readCancel = make(chan struct{})
+	}
+
+	cancel := dt.readCancel
+	if t.IsZero() {
+		return
+	}
+	if d := time.Until(t); d <= 0 {
+		close(cancel)
+	} else {
+		dt.readTimer = time.AfterFunc(d, func() { close(cancel) })
+	}
+}
+
+// SetWriteDeadline arranges for in-flight and future writes to fail with
+// ErrDeadlineExceeded once t is reached. A zero Time disables the deadline.
+func (dt *deadlineTimer) SetWriteDeadline(t time.Time) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	// The current channel is kept, so writes already blocked on it are bound
+	// by t, unless an earlier deadline has closed it (or is about to).
+	if dt.writeTimer != nil && !dt.writeTimer.Stop() {
+		dt.writeCancel = nil
+	}
+	dt.writeTimer = nil
+	select {
+	case <-dt.writeCancel:
+		dt.writeCancel = nil
+	default:
+	}
+	if dt.writeCancel == nil {
+		dt.writeCancel = make(chan struct{})
+	}
+
+	cancel := dt.writeCancel
+	if t.IsZero() {
+		return
+	}
+	if d := time.Until(t); d <= 0 {
+		close(cancel)
+	} else {
+		dt.writeTimer = time.AfterFunc(d, func() { close(cancel) })
+	}
+}
+
+func (dt *deadlineTimer) readCancelCh() <-chan struct{} {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.readCancel == nil {
+		dt.readCancel = make(chan struct{})
+	}
+	return dt.readCancel
+}
+
+func (dt *deadlineTimer) writeCancelCh() <-chan struct{} {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.writeCancel == nil {
+		dt.writeCancel = make(chan struct{})
+	}
+	return dt.writeCancel
+}
+
+// deadlineReader wraps an io.ReadCloser, failing a Read still in flight when
+// cancel's channel closes rather than when the next Read is attempted.
+type deadlineReader struct {
+	r      io.ReadCloser
+	cancel func() <-chan struct{}
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		n, err := d.r.Read(p)
+		done <- result{n, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.n, res.err
+	case <-d.cancel():
+		d.r.Close()
+		return 0, ErrDeadlineExceeded
+	}
+}
+
+func (d *deadlineReader) Close() error {
+	return d.r.Close()
+}
+
+// deadlineWriter wraps an io.Writer, failing a Write still in flight when
+// cancel's channel closes. Go gives us no way to interrupt a blocking
+// io.Writer, so a Write abandoned by a firing deadline may still be running
+// in the background after ErrDeadlineExceeded is returned; writeMu keeps
+// that abandoned write from ever overlapping a later one, and expired stops
+// deadlineWriter from starting any later one at all once a deadline fires.
+type deadlineWriter struct {
+	w      io.Writer
+	cancel func() <-chan struct{}
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	expired bool
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	expired := d.expired
+	d.mu.Unlock()
+	if expired {
+		return 0, ErrDeadlineExceeded
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		d.writeMu.Lock()
+		defer d.writeMu.Unlock()
+		n, err := d.w.Write(p)
+		done <- result{n, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.n, res.err
+	case <-d.cancel():
+		d.mu.Lock()
+		d.expired = true
+		d.mu.Unlock()
+		return 0, ErrDeadlineExceeded
+	}
+}
+
+// wireRequest mirrors query.Request's JSON shape without requiring a valid
+// OrganizationID. FluxService and FluxQueryService proxy a query to another
+// Flux server using a token, not an organization, so query.Request's own
+// MarshalJSON -- which always encodes OrganizationID and errors on a zero
+// platform.ID -- doesn't apply to the wire format these clients send.
+type wireRequest struct {
+	Compiler     flux.Compiler     `json:"compiler"`
+	CompilerType flux.CompilerType `json:"compiler_type"`
+}
+
+// wireProxyRequest is the JSON body FluxService and FluxQueryService send.
+type wireProxyRequest struct {
+	Request     wireRequest      `json:"request"`
+	Dialect     flux.Dialect     `json:"dialect"`
+	DialectType flux.DialectType `json:"dialect_type"`
+}
+
+func marshalProxyRequest(r *query.ProxyRequest) ([]byte, error) {
+	return json.Marshal(wireProxyRequest{
+		Request: wireRequest{
+			Compiler:     r.Request.Compiler,
+			CompilerType: r.Request.Compiler.CompilerType(),
+		},
+		Dialect:     r.Dialect,
+		DialectType: r.Dialect.DialectType(),
+	})
+}
+
+// FluxService connects to a remote flux query service.
+type FluxService struct {
+	URL                string
+	Token              string
+	InsecureSkipVerify bool
+	RetryPolicy        RetryPolicy
+	Compression        Compression
+
+	metrics *queryMetrics
+
+	clientOnce sync.Once
+	client     *http.Client
+
+	// deadlineTimer bounds the CSV streaming phase (the read from the
+	// response body and the write to the caller's w) independently of the
+	// initial handshake, which is bounded by RetryPolicy (ctx bounds both).
+	deadlineTimer
+}
+
+// httpClient returns the *http.Client used for s's requests, built once and
+// reused so connections are kept alive across retries and calls. It honors
+// InsecureSkipVerify by giving s its own Transport instead of sharing
+// http.DefaultClient's.
+func (s *FluxService) httpClient() *http.Client {
+	s.clientOnce.Do(func() { s.client = newHTTPClient(s.InsecureSkipVerify) })
+	return s.client
+}
+
+// WithMetrics registers Prometheus instrumentation for s's Query calls with
+// reg and returns s, so it can be chained off a struct literal. Collectors
+// are labeled client="proxy" so they can coexist on the same reg as a
+// FluxQueryService's.
+func (s *FluxService) WithMetrics(reg prometheus.Registerer) *FluxService {
+	s.metrics = newQueryMetrics(reg, "proxy")
+	return s
+}
+
+// Query runs a flux query against a remote server and writes the results to w.
+func (s *FluxService) Query(ctx context.Context, w io.Writer, r *query.ProxyRequest) (int64, error) {
+	if s.metrics != nil {
+		s.metrics.inFlight.Inc()
+		defer s.metrics.inFlight.Dec()
+	}
+	compiler := compilerType(r.Request.Compiler)
+
+	body, err := marshalProxyRequest(r)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := retryDo(ctx, s.httpClient(), &s.RetryPolicy, s.metrics, compiler, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		SetToken(s.Token, req)
+		req.Header.Set("Content-Type", "application/json")
+		setAcceptEncoding(req, s.Compression)
+		return req, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := CheckError(resp); err != nil {
+		resp.Body.Close()
+		return 0, err
+	}
+
+	decoded, err := decodeBody(resp)
+	if err != nil {
+		resp.Body.Close()
+		return 0, err
+	}
+
+	src := &deadlineReader{r: decoded, cancel: s.readCancelCh}
+	defer src.Close()
+
+	dst := &deadlineWriter{w: w, cancel: s.writeCancelCh}
+	n, err := io.Copy(dst, src)
+	if s.metrics != nil {
+		s.metrics.bytesStreamed.Add(float64(n))
+	}
+	return n, err
+}
+
+// FluxQueryService connects to a remote flux query service and decodes the
+// result into a flux.ResultIterator.
+type FluxQueryService struct {
+	URL                string
+	Token              string
+	InsecureSkipVerify bool
+	RetryPolicy        RetryPolicy
+	Compression        Compression
+
+	metrics *queryMetrics
+
+	clientOnce sync.Once
+	client     *http.Client
+}
+
+// httpClient returns the *http.Client used for s's requests, built once and
+// reused so connections are kept alive across retries and calls. It honors
+// InsecureSkipVerify by giving s its own Transport instead of sharing
+// http.DefaultClient's.
+func (s *FluxQueryService) httpClient() *http.Client {
+	s.clientOnce.Do(func() { s.client = newHTTPClient(s.InsecureSkipVerify) })
+	return s.client
+}
+
+// WithMetrics registers Prometheus instrumentation for s's Query calls with
+// reg and returns s, so it can be chained off a struct literal. Collectors
+// are labeled client="query" so they can coexist on the same reg as a
+// FluxService's.
+func (s *FluxQueryService) WithMetrics(reg prometheus.Registerer) *FluxQueryService {
+	s.metrics = newQueryMetrics(reg, "query")
+	return s
+}
+
+// QueryResultIterator is a flux.ResultIterator bound to the HTTP connection
+// it was decoded from. Cancel releases both the remaining results and the
+// connection; it's the name callers of FluxQueryService.Query use instead
+// of Release so the HTTP-specific release semantics (closing the response
+// body) are clear at the call site. SetReadDeadline/SetWriteDeadline bound
+// the CSV streaming phase independently of the ctx passed to Query, which
+// is attached to the HTTP request and so covers both the initial handshake
+// and the response body.
+type QueryResultIterator interface {
+	flux.ResultIterator
+	Cancel()
+	SetReadDeadline(t time.Time)
+	SetWriteDeadline(t time.Time)
+}
+
+// Query runs a flux query against a remote server and decodes the response
+// into a QueryResultIterator.
+func (s *FluxQueryService) Query(ctx context.Context, r *query.Request) (QueryResultIterator, error) {
+	if s.metrics != nil {
+		s.metrics.inFlight.Inc()
+		defer s.metrics.inFlight.Dec()
+	}
+	compiler := compilerType(r.Compiler)
+
+	pr := &query.ProxyRequest{
+		Request: *r,
+		Dialect: csv.DefaultDialect(),
+	}
+	body, err := marshalProxyRequest(pr)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := retryDo(ctx, s.httpClient(), &s.RetryPolicy, s.metrics, compiler, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		SetToken(s.Token, req)
+		req.Header.Set("Content-Type", "application/json")
+		setAcceptEncoding(req, s.Compression)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CheckError(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	decoded, err := decodeBody(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	qr := &httpQueryResult{}
+	decodedReader := &deadlineReader{r: decoded, cancel: qr.readCancelCh}
+
+	dec := csv.NewMultiResultDecoder(csv.ResultDecoderConfig{})
+	results, err := dec.Decode(decodedReader)
+	if err != nil {
+		decodedReader.Close()
+		return nil, err
+	}
+
+	qr.results = results
+	qr.body = decodedReader
+	return qr, nil
+}
+
+// httpQueryResult binds a decoded flux.ResultIterator to the underlying HTTP
+// response body so that Cancel also releases the connection. Its embedded
+// deadlineTimer lets callers bound the CSV streaming phase independently of
+// the initial handshake, which is bounded by RetryPolicy (ctx bounds both):
+// once a deadline fires, any read blocked inside Next() unblocks with
+// ErrDeadlineExceeded and the connection is closed.
+type httpQueryResult struct {
+	results flux.ResultIterator
+	body    io.ReadCloser
+
+	deadlineTimer
+}
+
+func (r *httpQueryResult) More() bool                  { return r.results.More() }
+func (r *httpQueryResult) Next() flux.Result           { return r.results.Next() }
+func (r *httpQueryResult) Err() error                  { return r.results.Err() }
+func (r *httpQueryResult) Statistics() flux.Statistics { return r.results.Statistics() }
+func (r *httpQueryResult) Release()                    { r.results.Release() }
+
+// Cancel stops decoding and releases the underlying connection. It is safe
+// to call concurrently with Next/More/Err from another goroutine, mirroring
+// what happens when a deadline set via SetReadDeadline fires.
+func (r *httpQueryResult) Cancel() {
+	r.results.Release()
+	r.body.Close()
+}
+
+// newHTTPClient returns the *http.Client a FluxService or FluxQueryService
+// should issue its requests through. http.DefaultClient is reused when
+// insecureSkipVerify is false so the common case pays no extra cost;
+// otherwise a client with its own Transport is built so skipping TLS
+// verification doesn't leak onto other users of http.DefaultClient.
+func newHTTPClient(insecureSkipVerify bool) *http.Client {
+	if !insecureSkipVerify {
+		return http.DefaultClient
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+// retryDo executes the *http.Request built by newRequest on client, retrying
+// according to policy on connection errors and on responses whose status is
+// in policy.RetryableStatuses. Since newRequest is called again on every
+// attempt, a retry never reuses a partially consumed request body. Retries
+// stop as soon as ctx is done. metrics may be nil, in which case no
+// instrumentation is recorded.
+func retryDo(ctx context.Context, client *http.Client, policy *RetryPolicy, metrics *queryMetrics, compiler string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	if policy.isZero() {
+		def := DefaultRetryPolicy
+		def.Clock = policy.Clock
+		policy = &def
+	}
+
+	clk := policy.clock()
+	start := clk.Now()
+
+	interval := policy.InitialInterval
+	if interval <= 0 {
+		interval = DefaultRetryPolicy.InitialInterval
+	}
+
+	// MaxRetries and MaxElapsedTime are defaulted independently of the rest
+	// of policy, so a caller who customizes one field (say, just
+	// RetryableStatuses) without touching these two still gets a bound on
+	// total retries instead of retrying a persistent failure forever.
+	maxRetries := policy.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = DefaultRetryPolicy.MaxRetries
+	}
+	maxElapsedTime := policy.MaxElapsedTime
+	if maxElapsedTime <= 0 {
+		maxElapsedTime = DefaultRetryPolicy.MaxElapsedTime
+	}
+
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		if ctx.Err() != nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, ctx.Err()
+		}
+
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+
+		attemptStart := time.Now()
+		resp, err := client.Do(req)
+		if metrics != nil {
+			code := "error"
+			if err == nil {
+				code = strconv.Itoa(resp.StatusCode)
+				metrics.timeToFirstByte.WithLabelValues(compiler).Observe(time.Since(attemptStart).Seconds())
+			}
+			metrics.requestsTotal.WithLabelValues(code, compiler).Inc()
+		}
+
+		if err == nil && !policy.isRetryableStatus(resp.StatusCode) {
+			if metrics != nil {
+				metrics.requestDuration.WithLabelValues(compiler).Observe(clk.Now().Sub(start).Seconds())
+			}
+			return resp, nil
+		}
+
+		wait := interval
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = CheckError(resp)
+			if ra := retryAfter(resp); ra > 0 {
+				wait = ra
+			}
+			resp.Body.Close()
+		}
+
+		giveUp := maxRetries > 0 && attempt+1 >= maxRetries
+		if !giveUp && maxElapsedTime > 0 && clk.Now().Sub(start)+wait > maxElapsedTime {
+			giveUp = true
+		}
+		if giveUp {
+			if metrics != nil {
+				metrics.requestDuration.WithLabelValues(compiler).Observe(clk.Now().Sub(start).Seconds())
+			}
+			return nil, lastErr
+		}
+
+		if metrics != nil {
+			metrics.retriesTotal.Inc()
+		}
+		if err := sleepContext(ctx, clk, wait); err != nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, err
+		}
+		interval = policy.nextInterval(interval)
+	}
+}
+
+// sleepContext sleeps for d on clk, or returns ctx.Err() early if ctx is
+// done first, so a cancelled caller isn't stuck waiting out a backoff
+// interval that can be as long as MaxInterval.
+func sleepContext(ctx context.Context, clk Clock, d time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		clk.Sleep(d)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// queryMetrics holds the Prometheus instrumentation shared by FluxService
+// and FluxQueryService. A nil *queryMetrics disables instrumentation.
+type queryMetrics struct {
+	requestsTotal   *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	timeToFirstByte *prometheus.HistogramVec
+	bytesStreamed   prometheus.Counter
+	retriesTotal    prometheus.Counter
+	inFlight        prometheus.Gauge
+}
+
+const queryMetricsNamespace = "flux_client"
+
+// newQueryMetrics builds the collectors used to instrument Flux HTTP
+// queries and, if reg is non-nil, registers them with it. client labels
+// every collector (e.g. "proxy" for FluxService, "query" for
+// FluxQueryService) so the two sets of otherwise-identically-named
+// collectors can be registered against the same reg without colliding.
+func newQueryMetrics(reg prometheus.Registerer, client string) *queryMetrics {
+	constLabels := prometheus.Labels{"client": client}
+	m := &queryMetrics{
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   queryMetricsNamespace,
+			Name:        "requests_total",
+			Help:        "Number of Flux query requests made, labeled by response status code and compiler type.",
+			ConstLabels: constLabels,
+		}, []string{"code", "compiler"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   queryMetricsNamespace,
+			Name:        "request_duration_seconds",
+			Help:        "Time taken for a Flux query request to complete, including any retries.",
+			Buckets:     prometheus.DefBuckets,
+			ConstLabels: constLabels,
+		}, []string{"compiler"}),
+		timeToFirstByte: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   queryMetricsNamespace,
+			Name:        "time_to_first_byte_seconds",
+			Help:        "Time from sending a request to receiving the first byte of its response.",
+			Buckets:     prometheus.DefBuckets,
+			ConstLabels: constLabels,
+		}, []string{"compiler"}),
+		bytesStreamed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   queryMetricsNamespace,
+			Name:        "bytes_streamed_total",
+			Help:        "Number of response bytes streamed to FluxService callers.",
+			ConstLabels: constLabels,
+		}),
+		retriesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   queryMetricsNamespace,
+			Name:        "retries_total",
+			Help:        "Number of request retries performed.",
+			ConstLabels: constLabels,
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   queryMetricsNamespace,
+			Name:        "in_flight_requests",
+			Help:        "Number of Flux query requests currently in flight.",
+			ConstLabels: constLabels,
+		}),
+	}
+
+	if reg != nil {
+		reg.MustRegister(
+			m.requestsTotal,
+			m.requestDuration,
+			m.timeToFirstByte,
+			m.bytesStreamed,
+			m.retriesTotal,
+			m.inFlight,
+		)
+	}
+
+	return m
+}
+
+// compilerType returns the label used to distinguish FluxCompiler,
+// SpecCompiler and ASTCompiler requests in metrics.
+func compilerType(c flux.Compiler) string {
+	if c == nil {
+		return "unknown"
+	}
+	return string(c.CompilerType())
+}
+
+// retryAfter parses the Retry-After header of resp, returning 0 if it is
+// absent or malformed.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// SetToken sets the authorization header on req using InfluxDB's token auth
+// scheme.
+func SetToken(token string, req *http.Request) {
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+}
+
+// CheckError reads the response and returns an error describing it if its
+// status code does not indicate success.
+func CheckError(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, string(body))
+}
@@ -2,17 +2,23 @@ package http
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"regexp"
 	"testing"
+	"time"
 
+	"github.com/influxdata/flux"
 	"github.com/influxdata/flux/csv"
 	"github.com/influxdata/flux/lang"
 	"github.com/influxdata/platform/query"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestFluxService_Query(t *testing.T) {
@@ -181,3 +187,452 @@ var crlfPattern = regexp.MustCompile(`\r?\n`)
 func toCRLF(data string) string {
 	return crlfPattern.ReplaceAllString(data, "\r\n")
 }
+
+// fakeClock lets tests drive RetryPolicy backoff without real sleeps.
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+func TestFluxService_Query_RetriesOnTransientFailure(t *testing.T) {
+	const failures = 2
+	var requests int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "howdy")
+	}))
+	defer ts.Close()
+
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	s := &FluxService{
+		URL:   ts.URL,
+		Token: "mytoken",
+		RetryPolicy: RetryPolicy{
+			InitialInterval:     10 * time.Millisecond,
+			MaxInterval:         100 * time.Millisecond,
+			Multiplier:          2,
+			RandomizationFactor: 0,
+			MaxElapsedTime:      time.Second,
+			MaxRetries:          5,
+			RetryableStatuses:   []int{http.StatusServiceUnavailable},
+			Clock:               clk,
+		},
+	}
+
+	w := &bytes.Buffer{}
+	n, err := s.Query(context.Background(), w, &query.ProxyRequest{
+		Request: query.Request{
+			Compiler: lang.FluxCompiler{Query: "from()"},
+		},
+		Dialect: csv.DefaultDialect(),
+	})
+	if err != nil {
+		t.Fatalf("FluxService.Query() error = %v", err)
+	}
+	if want := int64(len("howdy\n")); n != want {
+		t.Errorf("FluxService.Query() = %v, want %v", n, want)
+	}
+	if got := w.String(); got != "howdy\n" {
+		t.Errorf("FluxService.Query() body = %q, want %q", got, "howdy\n")
+	}
+	if requests != failures+1 {
+		t.Errorf("server received %d requests, want %d", requests, failures+1)
+	}
+	if len(clk.sleeps) != failures {
+		t.Errorf("retried %d times, want %d", len(clk.sleeps), failures)
+	}
+}
+
+func TestFluxService_Query_GivesUpAfterMaxRetries(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	s := &FluxService{
+		URL:   ts.URL,
+		Token: "mytoken",
+		RetryPolicy: RetryPolicy{
+			InitialInterval:   10 * time.Millisecond,
+			MaxInterval:       100 * time.Millisecond,
+			Multiplier:        2,
+			MaxElapsedTime:    time.Second,
+			MaxRetries:        3,
+			RetryableStatuses: []int{http.StatusServiceUnavailable},
+			Clock:             clk,
+		},
+	}
+
+	w := &bytes.Buffer{}
+	_, err := s.Query(context.Background(), w, &query.ProxyRequest{
+		Request: query.Request{
+			Compiler: lang.FluxCompiler{Query: "from()"},
+		},
+		Dialect: csv.DefaultDialect(),
+	})
+	if err == nil {
+		t.Fatal("FluxService.Query() error = nil, want non-nil after exhausting retries")
+	}
+	if len(clk.sleeps) != 2 {
+		t.Errorf("retried %d times, want %d", len(clk.sleeps), 2)
+	}
+}
+
+func TestFluxService_Query_ConnectionErrorDoesNotHang(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := ts.URL
+	ts.Close() // nothing is listening on url any more
+
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	s := &FluxService{
+		URL:   url,
+		Token: "mytoken",
+		RetryPolicy: RetryPolicy{
+			Clock: clk, // everything else left at zero value
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		w := &bytes.Buffer{}
+		_, err := s.Query(context.Background(), w, &query.ProxyRequest{
+			Request: query.Request{
+				Compiler: lang.FluxCompiler{Query: "from()"},
+			},
+			Dialect: csv.DefaultDialect(),
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("FluxService.Query() error = nil, want non-nil for a connection error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("FluxService.Query() did not return; a zero-value RetryPolicy must still bound retries on connection errors")
+	}
+	if got, want := len(clk.sleeps), DefaultRetryPolicy.MaxRetries-1; got != want {
+		t.Errorf("retried %d times, want %d", got, want)
+	}
+}
+
+func TestFluxService_Query_PartialRetryPolicyStillBoundsRetries(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := ts.URL
+	ts.Close() // nothing is listening on url any more
+
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	s := &FluxService{
+		URL:   url,
+		Token: "mytoken",
+		RetryPolicy: RetryPolicy{
+			// MaxRetries and MaxElapsedTime are left at 0; only
+			// RetryableStatuses is customized. Both bounds must still
+			// default independently rather than disabling retries' cap.
+			RetryableStatuses: []int{http.StatusServiceUnavailable},
+			Clock:             clk,
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		w := &bytes.Buffer{}
+		_, err := s.Query(context.Background(), w, &query.ProxyRequest{
+			Request: query.Request{
+				Compiler: lang.FluxCompiler{Query: "from()"},
+			},
+			Dialect: csv.DefaultDialect(),
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("FluxService.Query() error = nil, want non-nil for a connection error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("FluxService.Query() did not return; a partially customized RetryPolicy must still bound MaxRetries/MaxElapsedTime")
+	}
+	if got, want := len(clk.sleeps), DefaultRetryPolicy.MaxRetries-1; got != want {
+		t.Errorf("retried %d times, want %d", got, want)
+	}
+}
+
+func TestFluxService_Query_ReadDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		for i := 0; i < 100; i++ {
+			fmt.Fprintln(w, "row")
+			flusher.Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	s := &FluxService{URL: ts.URL, Token: "mytoken"}
+	s.SetReadDeadline(time.Now().Add(30 * time.Millisecond))
+
+	w := &bytes.Buffer{}
+	n, err := s.Query(context.Background(), w, &query.ProxyRequest{
+		Request: query.Request{
+			Compiler: lang.FluxCompiler{Query: "from()"},
+		},
+		Dialect: csv.DefaultDialect(),
+	})
+	if err != ErrDeadlineExceeded {
+		t.Fatalf("FluxService.Query() error = %v, want %v", err, ErrDeadlineExceeded)
+	}
+	if n <= 0 || n >= 100*int64(len("row\n")) {
+		t.Errorf("FluxService.Query() n = %d, want a partial read", n)
+	}
+}
+
+// slowWriter sleeps before every Write, so tests can make a deadline fire
+// while a write to w is still in flight.
+type slowWriter struct {
+	w     io.Writer
+	delay time.Duration
+}
+
+func (sw *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(sw.delay)
+	return sw.w.Write(p)
+}
+
+func TestFluxService_Query_WriteDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 100; i++ {
+			fmt.Fprintln(w, "row")
+		}
+	}))
+	defer ts.Close()
+
+	s := &FluxService{URL: ts.URL, Token: "mytoken"}
+	s.SetWriteDeadline(time.Now().Add(30 * time.Millisecond))
+
+	w := &slowWriter{w: &bytes.Buffer{}, delay: 50 * time.Millisecond}
+	_, err := s.Query(context.Background(), w, &query.ProxyRequest{
+		Request: query.Request{
+			Compiler: lang.FluxCompiler{Query: "from()"},
+		},
+		Dialect: csv.DefaultDialect(),
+	})
+	if err != ErrDeadlineExceeded {
+		t.Fatalf("FluxService.Query() error = %v, want %v", err, ErrDeadlineExceeded)
+	}
+}
+
+func TestFluxQueryService_Query_CancelMidStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		fmt.Fprintln(w, `#datatype,string,long,dateTime:RFC3339,double,long,string,boolean,string,string,string
+#group,false,false,false,false,false,false,false,true,true,true
+#default,0,,,,,,,,,
+,result,table,_time,usage_user,test,mystr,this,cpu,host,_measurement`)
+		flusher.Flush()
+		for i := 0; i < 100; i++ {
+			fmt.Fprintln(w, ",,0,2018-08-29T13:08:47Z,10.2,10,yay,true,cpu-total,a,cpui")
+			flusher.Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	s := &FluxQueryService{URL: ts.URL, Token: "mytoken"}
+	res, err := s.Query(context.Background(), &query.Request{
+		Compiler: lang.FluxCompiler{Query: "from()"},
+	})
+	if err != nil {
+		t.Fatalf("FluxQueryService.Query() error = %v", err)
+	}
+
+	time.AfterFunc(30*time.Millisecond, func() {
+		res.SetReadDeadline(time.Now())
+	})
+
+	for res.More() {
+		result := res.Next()
+		result.Tables().Do(func(flux.Table) error { return nil })
+	}
+	if res.Err() != ErrDeadlineExceeded {
+		t.Errorf("FluxQueryService.Query() stream error = %v, want %v", res.Err(), ErrDeadlineExceeded)
+	}
+}
+
+func TestFluxService_Query_Metrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "howdy")
+	}))
+	defer ts.Close()
+
+	reg := prometheus.NewRegistry()
+	s := (&FluxService{URL: ts.URL, Token: "mytoken"}).WithMetrics(reg)
+
+	w := &bytes.Buffer{}
+	if _, err := s.Query(context.Background(), w, &query.ProxyRequest{
+		Request: query.Request{
+			Compiler: lang.FluxCompiler{Query: "from()"},
+		},
+		Dialect: csv.DefaultDialect(),
+	}); err != nil {
+		t.Fatalf("FluxService.Query() error = %v", err)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+
+	got := map[string]*dto.MetricFamily{}
+	for _, f := range families {
+		got[f.GetName()] = f
+	}
+
+	if f, ok := got["flux_client_requests_total"]; !ok || f.Metric[0].GetCounter().GetValue() != 1 {
+		t.Errorf("flux_client_requests_total = %v, want a single observation of 1", f)
+	}
+	if _, ok := got["flux_client_request_duration_seconds"]; !ok {
+		t.Error("flux_client_request_duration_seconds was not registered")
+	}
+	if _, ok := got["flux_client_time_to_first_byte_seconds"]; !ok {
+		t.Error("flux_client_time_to_first_byte_seconds was not registered")
+	}
+	if f, ok := got["flux_client_bytes_streamed_total"]; !ok || f.Metric[0].GetCounter().GetValue() != 6 {
+		t.Errorf("flux_client_bytes_streamed_total = %v, want 6", f)
+	}
+	if _, ok := got["flux_client_in_flight_requests"]; !ok {
+		t.Error("flux_client_in_flight_requests was not registered")
+	}
+}
+
+func TestFluxService_Query_InsecureSkipVerify(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "howdy")
+	}))
+	defer ts.Close()
+
+	s := &FluxService{URL: ts.URL, Token: "mytoken"}
+	w := &bytes.Buffer{}
+	if _, err := s.Query(context.Background(), w, &query.ProxyRequest{
+		Request: query.Request{
+			Compiler: lang.FluxCompiler{Query: "from()"},
+		},
+		Dialect: csv.DefaultDialect(),
+	}); err == nil {
+		t.Fatal("FluxService.Query() error = nil, want a TLS verification error against a self-signed server")
+	}
+
+	s = &FluxService{URL: ts.URL, Token: "mytoken", InsecureSkipVerify: true}
+	w = &bytes.Buffer{}
+	if _, err := s.Query(context.Background(), w, &query.ProxyRequest{
+		Request: query.Request{
+			Compiler: lang.FluxCompiler{Query: "from()"},
+		},
+		Dialect: csv.DefaultDialect(),
+	}); err != nil {
+		t.Fatalf("FluxService.Query() error = %v, want nil with InsecureSkipVerify: true", err)
+	}
+	if got := w.String(); got != "howdy\n" {
+		t.Errorf("FluxService.Query() body = %q, want %q", got, "howdy\n")
+	}
+}
+
+func TestWithMetrics_FluxServiceAndFluxQueryServiceShareRegistry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("registering both FluxService and FluxQueryService metrics on one Registerer panicked: %v", r)
+		}
+	}()
+
+	(&FluxService{}).WithMetrics(reg)
+	(&FluxQueryService{}).WithMetrics(reg)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+
+	for _, f := range families {
+		if f.GetName() != "flux_client_in_flight_requests" {
+			continue
+		}
+		if got := len(f.Metric); got != 2 {
+			t.Errorf("flux_client_in_flight_requests has %d series, want 2 (one per client label)", got)
+		}
+	}
+}
+
+func TestFluxService_Query_GzipResponse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("request Accept-Encoding = %q, want %q", r.Header.Get("Accept-Encoding"), "gzip")
+		}
+
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		fmt.Fprintln(gz, "howdy")
+		gz.Close()
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(buf.Bytes())
+	}))
+	defer ts.Close()
+
+	s := &FluxService{URL: ts.URL, Token: "mytoken"}
+
+	w := &bytes.Buffer{}
+	n, err := s.Query(context.Background(), w, &query.ProxyRequest{
+		Request: query.Request{
+			Compiler: lang.FluxCompiler{Query: "from()"},
+		},
+		Dialect: csv.DefaultDialect(),
+	})
+	if err != nil {
+		t.Fatalf("FluxService.Query() error = %v", err)
+	}
+	if want := int64(len("howdy\n")); n != want {
+		t.Errorf("FluxService.Query() = %v, want %v", n, want)
+	}
+	if got := w.String(); got != "howdy\n" {
+		t.Errorf("FluxService.Query() body = %q, want %q", got, "howdy\n")
+	}
+}
+
+func TestFluxService_Query_CompressionNone(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if enc := r.Header.Get("Accept-Encoding"); enc != "identity" {
+			t.Errorf("request Accept-Encoding = %q, want %q", enc, "identity")
+		}
+		fmt.Fprintln(w, "howdy")
+	}))
+	defer ts.Close()
+
+	s := &FluxService{URL: ts.URL, Token: "mytoken", Compression: CompressionNone}
+
+	w := &bytes.Buffer{}
+	if _, err := s.Query(context.Background(), w, &query.ProxyRequest{
+		Request: query.Request{
+			Compiler: lang.FluxCompiler{Query: "from()"},
+		},
+		Dialect: csv.DefaultDialect(),
+	}); err != nil {
+		t.Fatalf("FluxService.Query() error = %v", err)
+	}
+}